@@ -11,6 +11,11 @@ import (
 	"io"
 )
 
+// Key32FromPassphrase derives a 32-byte key from passphrase with a single
+// HMAC-SHA512/256 pass. It is no longer used to derive the key for --psk
+// mode, which now runs the passphrase through Argon2id instead (see
+// argon2Key in handshake.go); it remains here as the deterministic key
+// derivation the StreamEncryptor/StreamDecryptor tests use.
 func Key32FromPassphrase(tag, passphrase string) [32]byte {
 	var key [32]byte
 
@@ -25,12 +30,54 @@ func Key32FromPassphrase(tag, passphrase string) [32]byte {
 
 const EncryptionChunkSize = 1024
 
+// saltSize is the number of random bytes written at the start of the stream
+// and mixed into every frame's nonce. It, together with the per-frame
+// counter, forms the 12-byte AES-GCM nonce required by the STREAM
+// construction: salt || big-endian uint32(counter).
+const saltSize = 8
+
+// finalFrameBit is OR'd into the big-endian counter of the frame that
+// terminates a stream, so its nonce can never collide with a non-final
+// frame at the same counter value, and a truncated stream can be detected
+// because no frame ever claims to be final until the sender intends EOF.
+const finalFrameBit = uint32(1) << 31
+
+// frameNonce derives the 12-byte AES-GCM nonce for the frame at the given
+// counter, per the STREAM construction: a random per-stream salt
+// concatenated with a big-endian frame counter, with the top bit of the
+// counter reserved to mark the final frame of the stream.
+func frameNonce(salt []byte, counter uint32, final bool) []byte {
+	if final {
+		counter |= finalFrameBit
+	}
+	nonce := make([]byte, len(salt)+4)
+	copy(nonce, salt)
+	binary.BigEndian.PutUint32(nonce[len(salt):], counter)
+	return nonce
+}
+
+// frameAAD binds the same counter (and final marker) used to derive the
+// nonce into the AEAD's additional authenticated data, so a frame cut from
+// one position in the stream and spliced into another fails to open even
+// on the off chance its ciphertext alone might otherwise be mistaken for
+// valid at the new position.
+func frameAAD(counter uint32, final bool) []byte {
+	if final {
+		counter |= finalFrameBit
+	}
+	var aad [4]byte
+	binary.BigEndian.PutUint32(aad[:], counter)
+	return aad[:]
+}
+
 type StreamDecryptor struct {
 	aead      cipher.AEAD
 	ior       io.Reader
 	idx       int // read index for plaintext
 	err       error
-	nonce     []byte
+	salt      []byte
+	counter   uint32
+	finalSeen bool
 	plaintext []byte
 }
 
@@ -47,26 +94,34 @@ func NewDecryptor(rc io.Reader, key [32]byte) (*StreamDecryptor, error) {
 		return nil, err
 	}
 
-	// Read the nonce from beginning of the stream
-	nonce := make([]byte, gcm.NonceSize())
-	_, err = io.ReadFull(rc, nonce)
+	// Read the salt from beginning of the stream. The per-frame nonce is
+	// derived from this salt plus a frame counter; see frameNonce.
+	salt := make([]byte, saltSize)
+	_, err = io.ReadFull(rc, salt)
 	if err != nil {
-		return nil, fmt.Errorf("cannot read nonce: %s", err)
+		return nil, fmt.Errorf("cannot read salt: %s", err)
 	}
 
 	return &StreamDecryptor{
-		aead:  gcm,
-		nonce: nonce,
-		ior:   rc,
+		aead: gcm,
+		salt: salt,
+		ior:  rc,
 	}, nil
 }
 
 func (sd *StreamDecryptor) Close() error {
+	err := sd.err
+	if err == io.EOF {
+		// readFrame stores the sentinel io.EOF once it has authenticated the
+		// final frame; that is the normal, successful end of stream, not a
+		// failure to report to the caller.
+		err = nil
+	}
 	sd.aead = nil
 	sd.ior = nil
-	sd.nonce = nil
+	sd.salt = nil
 	sd.plaintext = nil
-	return sd.err
+	return err
 }
 
 //                idx
@@ -86,28 +141,9 @@ func (sd *StreamDecryptor) Read(buf []byte) (int, error) {
 	for len(buf) > idx {
 		// When nothing left to copy from plaintext buffer
 		if sd.idx == len(sd.plaintext) {
-			// Read the number of ciphertext bytes that are available.
-			var sizeBuffer [8]byte
-			_, sd.err = io.ReadFull(sd.ior, sizeBuffer[:])
-			if sd.err != nil {
+			if sd.err = sd.readFrame(); sd.err != nil {
 				return idx, sd.err
 			}
-
-			size := int(binary.BigEndian.Uint64(sizeBuffer[:]))
-			ciphertext := make([]byte, size)
-
-			// Read the ciphertext bytes.
-			_, sd.err = io.ReadFull(sd.ior, ciphertext)
-			if sd.err != nil {
-				return idx, fmt.Errorf("cannot read %d byte frame: %s", size, sd.err)
-			}
-
-			// Then decrypt into the plaintext buffer.
-			sd.plaintext, sd.err = sd.aead.Open(nil, sd.nonce, ciphertext, nil)
-			if sd.err != nil {
-				return idx, fmt.Errorf("cannot decrypt ciphertext: %s", sd.err)
-			}
-			sd.idx = 0
 		}
 
 		// Copy data from plaintext buffer to client buffer
@@ -119,12 +155,59 @@ func (sd *StreamDecryptor) Read(buf []byte) (int, error) {
 	return idx, nil
 }
 
+// readFrame reads and decrypts the next ciphertext frame from the
+// underlying reader, leaving the result in sd.plaintext. The nonce for
+// each frame is derived locally from sd.counter rather than trusted from
+// the wire, so a reordered or duplicated frame is decrypted against the
+// nonce its position demands, not the nonce it was encrypted with, and
+// authentication fails. Because the decryptor cannot know in advance
+// whether a given frame is the final one, it first tries the non-final
+// nonce for the current position, then the final one; whichever
+// authenticates determines whether the stream is now complete.
+func (sd *StreamDecryptor) readFrame() error {
+	if sd.finalSeen {
+		return io.EOF
+	}
+
+	var sizeBuffer [8]byte
+	_, err := io.ReadFull(sd.ior, sizeBuffer[:])
+	if err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("stream ended before final frame was seen: %w", io.ErrUnexpectedEOF)
+		}
+		return fmt.Errorf("cannot read frame length: %s", err)
+	}
+
+	size := int(binary.BigEndian.Uint64(sizeBuffer[:]))
+	ciphertext := make([]byte, size)
+	if _, err = io.ReadFull(sd.ior, ciphertext); err != nil {
+		return fmt.Errorf("cannot read %d byte frame: %s", size, err)
+	}
+
+	if plaintext, openErr := sd.aead.Open(nil, frameNonce(sd.salt, sd.counter, false), ciphertext, frameAAD(sd.counter, false)); openErr == nil {
+		sd.plaintext, sd.idx = plaintext, 0
+		sd.counter++
+		return nil
+	}
+
+	plaintext, err := sd.aead.Open(nil, frameNonce(sd.salt, sd.counter, true), ciphertext, frameAAD(sd.counter, true))
+	if err != nil {
+		return fmt.Errorf("cannot decrypt frame %d: %s", sd.counter, err)
+	}
+	sd.plaintext, sd.idx = plaintext, 0
+	sd.counter++
+	sd.finalSeen = true
+	return nil
+}
+
 type StreamEncryptor struct {
 	aead      cipher.AEAD
 	iow       io.Writer
 	idx       int
 	err       error
-	nonce     []byte
+	salt      []byte
+	counter   uint32
+	closed    bool
 	plaintext []byte
 }
 
@@ -141,36 +224,40 @@ func NewEncryptor(wc io.Writer, key [32]byte) (*StreamEncryptor, error) {
 		return nil, err
 	}
 
-	// Generate a randomized nonce
-	nonce := make([]byte, gcm.NonceSize())
-	_, err = io.ReadFull(rand.Reader, nonce)
+	// Generate a randomized per-stream salt. Unlike a reused nonce, this
+	// salt is safe to send in the clear: each frame's actual nonce also
+	// includes a monotonic counter, so no two frames are ever sealed
+	// under the same nonce.
+	salt := make([]byte, saltSize)
+	_, err = io.ReadFull(rand.Reader, salt)
 	if err != nil {
 		return nil, err
 	}
 
-	// Write the nonce to beginning of the stream
-	_, err = wc.Write(nonce)
+	// Write the salt to beginning of the stream
+	_, err = wc.Write(salt)
 	if err != nil {
-		return nil, fmt.Errorf("cannot write nonce: %s", err)
+		return nil, fmt.Errorf("cannot write salt: %s", err)
 	}
 
 	return &StreamEncryptor{
 		aead:      gcm,
-		nonce:     nonce,
+		salt:      salt,
 		iow:       wc,
 		plaintext: make([]byte, EncryptionChunkSize),
 	}, nil
 }
 
 func (se *StreamEncryptor) Close() error {
-	err := se.Flush()
-	// Only overwrite instance error when it is already nil.
-	if se.err == nil {
-		se.err = err
+	if se.err == nil && !se.closed {
+		se.closed = true
+		buf := se.plaintext[:se.idx]
+		se.idx = 0
+		_, se.err = se.writeFrame(buf, true)
 	}
 	se.aead = nil
 	se.iow = nil
-	se.nonce = nil
+	se.salt = nil
 	se.plaintext = nil
 	return se.err
 }
@@ -180,8 +267,9 @@ func (se *StreamEncryptor) Flush() error {
 		return se.err
 	}
 	if se.idx > 0 {
-		_, se.err = se.writeFrame(se.plaintext[:se.idx])
+		buf := se.plaintext[:se.idx]
 		se.idx = 0
+		_, se.err = se.writeFrame(buf, false)
 	}
 	return se.err
 }
@@ -213,19 +301,20 @@ func (se *StreamEncryptor) Write(buf []byte) (int, error) {
 	}
 
 	// Send this blob
-	_, se.err = se.writeFrame(buf)
+	_, se.err = se.writeFrame(buf, false)
 	if se.err != nil {
 		return 0, se.err
 	}
 	return len(buf), nil
 }
 
-func (se *StreamEncryptor) writeFrame(buf []byte) (int, error) {
+func (se *StreamEncryptor) writeFrame(buf []byte, final bool) (int, error) {
 	if se.err != nil {
 		return 0, se.err
 	}
 
-	ciphertext := se.aead.Seal(nil, se.nonce, buf, nil)
+	ciphertext := se.aead.Seal(nil, frameNonce(se.salt, se.counter, final), buf, frameAAD(se.counter, final))
+	se.counter++
 
 	var sizeBuffer [8]byte
 	binary.BigEndian.PutUint64(sizeBuffer[:], uint64(len(ciphertext)))
@@ -3,6 +3,8 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"io"
 	"testing"
 )
 
@@ -15,7 +17,7 @@ func TestEncryption(t *testing.T) {
 	}
 
 	cipherstream := new(bytes.Buffer)
-	se, err := NewEncryptor(cipherstream, key)
+	se, err := NewEncryptor(cipherstream, key1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -33,7 +35,7 @@ func TestEncryption(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	sd, err := NewDecryptor(cipherstream, key)
+	sd, err := NewDecryptor(cipherstream, key1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -60,3 +62,128 @@ func TestEncryption(t *testing.T) {
 		t.Fatalf("GOT: %q; WANT: %q", got, want)
 	}
 }
+
+// encryptFrames writes each of items as its own frame (forcing a Flush
+// between each one) and returns the raw encrypted stream, so the tests
+// below can mutate individual ciphertext frames.
+func encryptFrames(t *testing.T, key [32]byte, items []string) *bytes.Buffer {
+	t.Helper()
+
+	cipherstream := new(bytes.Buffer)
+	se, err := NewEncryptor(cipherstream, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		if _, err = se.Write([]byte(item)); err != nil {
+			t.Fatal(err)
+		}
+		if err = se.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = se.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return cipherstream
+}
+
+// readFrames splits an encrypted stream produced by encryptFrames back into
+// its individual length-prefixed frames, without decrypting them.
+func readFrames(t *testing.T, cipherstream *bytes.Buffer) (salt []byte, frames [][]byte) {
+	t.Helper()
+
+	salt = make([]byte, saltSize)
+	if _, err := cipherstream.Read(salt); err != nil {
+		t.Fatal(err)
+	}
+	for cipherstream.Len() > 0 {
+		var sizeBuffer [8]byte
+		if _, err := cipherstream.Read(sizeBuffer[:]); err != nil {
+			t.Fatal(err)
+		}
+		size := int(binary.BigEndian.Uint64(sizeBuffer[:]))
+		frame := make([]byte, size)
+		if _, err := cipherstream.Read(frame); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, append(sizeBuffer[:], frame...))
+	}
+	return salt, frames
+}
+
+func TestEncryptionDetectsTruncation(t *testing.T) {
+	key := Key32FromPassphrase("some-tag", "test-passphrase")
+	cipherstream := encryptFrames(t, key, []string{"one", "two", "three"})
+
+	salt, frames := readFrames(t, cipherstream)
+	if got, want := len(frames), 4; got != want { // 3 data frames + final frame
+		t.Fatalf("GOT: %v; WANT: %v", got, want)
+	}
+
+	// Drop the final frame, so the stream ends before its final marker.
+	truncated := new(bytes.Buffer)
+	truncated.Write(salt)
+	for _, frame := range frames[:len(frames)-1] {
+		truncated.Write(frame)
+	}
+
+	sd, err := NewDecryptor(truncated, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sd.Read(make([]byte, 64)); err == nil {
+		t.Fatal("GOT: nil; WANT: error reading truncated stream")
+	}
+	if _, err = io.ReadAll(sd); err == nil {
+		t.Fatal("GOT: nil; WANT: error reading truncated stream")
+	}
+}
+
+func TestEncryptionDetectsReordering(t *testing.T) {
+	key := Key32FromPassphrase("some-tag", "test-passphrase")
+	cipherstream := encryptFrames(t, key, []string{"one", "two", "three"})
+
+	salt, frames := readFrames(t, cipherstream)
+
+	// Swap the first two data frames.
+	frames[0], frames[1] = frames[1], frames[0]
+
+	reordered := new(bytes.Buffer)
+	reordered.Write(salt)
+	for _, frame := range frames {
+		reordered.Write(frame)
+	}
+
+	sd, err := NewDecryptor(reordered, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadAll(sd); err == nil {
+		t.Fatal("GOT: nil; WANT: error decrypting reordered frame")
+	}
+}
+
+func TestEncryptionDetectsDuplication(t *testing.T) {
+	key := Key32FromPassphrase("some-tag", "test-passphrase")
+	cipherstream := encryptFrames(t, key, []string{"one", "two", "three"})
+
+	salt, frames := readFrames(t, cipherstream)
+
+	// Duplicate the first data frame in place of the second.
+	frames[1] = frames[0]
+
+	duplicated := new(bytes.Buffer)
+	duplicated.Write(salt)
+	for _, frame := range frames {
+		duplicated.Write(frame)
+	}
+
+	sd, err := NewDecryptor(duplicated, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadAll(sd); err == nil {
+		t.Fatal("GOT: nil; WANT: error decrypting duplicated frame")
+	}
+}
@@ -1,9 +1,9 @@
 package main
 
 import (
-	"archive/tar"
 	"bufio"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -11,18 +11,67 @@ import (
 	"path/filepath"
 	"time"
 
-	"github.com/karrick/godirwalk"
 	"github.com/karrick/golf"
 )
 
+// errUnsupportedEntry identifies errors from an entry tar-pipe refuses to
+// archive, such as a socket, so tarpath's ErrorCallback can tell them apart
+// from ordinary I/O errors and, when --fail-on-unsupported was given, halt
+// the walk instead of skipping past them with a warning.
+var errUnsupportedEntry = errors.New("unsupported entry")
+
 const bufferSize = 4096
 
+// Permission bits tar.Header.Mode expects beyond the usual rwx triplets,
+// matching the encoding used throughout the tar formats (see POSIX c_IS*).
+const (
+	c_ISUID = 0o4000
+	c_ISGID = 0o2000
+	c_ISVTX = 0o1000
+)
+
+// fileIdentity carries the stat(2) fields tarnode needs beyond what
+// os.FileInfo exposes: the (dev, ino) pair used to recognize hardlinks, how
+// many names the inode has, its device number if it is itself a device
+// node, and whether it has holes. populateMetadata fills this in on unix
+// builds; the Windows stub leaves it zeroed, which disables hardlink,
+// device, and sparse-file detection there.
+type fileIdentity struct {
+	Dev, Ino uint64
+	Nlink    uint64
+	Rdev     uint64
+	Sparse   bool
+}
+
+// inodeKey identifies an inode within a single filesystem, used to recognize
+// when a send walk encounters a second name for an already-seen hardlink.
+type inodeKey struct {
+	Dev, Ino uint64
+}
+
 var (
-	key        [32]byte
-	optHelp    = golf.BoolP('h', "help", false, "print help then exit")
-	optSecure  = golf.BoolP('s', "secure", false, "prompt for passphrase and use symmetric key encryption")
-	optVerbose = golf.BoolP('v', "verbose", false, "print verbose information")
-	optZip     = golf.BoolP('z', "gzip", false, "(de-)compress with gzip")
+	// sendKey and recvKey are the directional AES-GCM keys used to wrap the
+	// tar stream once *optSecure is given. negotiateInitiatorKeys and
+	// negotiateResponderKeys populate them, either from a Noise-IK-style
+	// handshake or, under --psk, from an Argon2id-stretched passphrase; see
+	// handshake.go.
+	sendKey, recvKey [32]byte
+
+	// passphrase holds the line read from stdin when --secure and --psk are
+	// both given; it is consumed by negotiateInitiatorKeys/
+	// negotiateResponderKeys, not used directly.
+	passphrase string
+
+	optFailOnUnsupported = golf.Bool("fail-on-unsupported", false, "exit with an error instead of a warning when skipping an unsupported entry, such as a socket")
+	optHelp              = golf.BoolP('h', "help", false, "print help then exit")
+	optJobs              = golf.Int("jobs", 4, "number of concurrent file-body workers used by send")
+	optNumericOwner      = golf.Bool("numeric-owner", false, "store and restore numeric uid/gid instead of user/group names")
+	optPeer              = golf.String("peer", "", "hex-encoded public key of the remote peer, required by send unless --psk is given")
+	optPipelineDepth     = golf.Int("pipeline-depth", 16, "number of frames/files the mux may buffer ahead of the network")
+	optPSK               = golf.Bool("psk", false, "use a shared passphrase (Argon2id) instead of the key-agreement handshake")
+	optSecure            = golf.BoolP('s', "secure", false, "authenticate and encrypt the connection, by key-agreement handshake or, with --psk, a shared passphrase")
+	optVerbose           = golf.BoolP('v', "verbose", false, "print verbose information")
+	optZip               = golf.BoolP('z', "gzip", false, "(de-)compress with gzip")
 )
 
 func main() {
@@ -46,15 +95,15 @@ func main() {
 		usage("expected sub-command")
 	}
 
-	if *optSecure {
+	if *optSecure && *optPSK {
 		fmt.Printf("Passphrase: ")
 		reader := bufio.NewReader(os.Stdin)
-		passphrase, err := reader.ReadString('\n')
+		var err error
+		passphrase, err = reader.ReadString('\n')
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "cannot read input: %s", err)
 			os.Exit(1)
 		}
-		key = Key32FromPassphrase(passphrase, passphrase)
 	}
 
 	cmd, args := args[0], args[1:]
@@ -67,6 +116,8 @@ func main() {
 		exit(receiveLines(args))
 	case "sendLines":
 		exit(sendLines(args))
+	case "identity":
+		exit(identity(args))
 	default:
 		usage(fmt.Sprintf("invalid sub-command: %q", cmd))
 	}
@@ -102,6 +153,13 @@ func withDial(remote string, callback func(io.Writer) error) error {
 	}
 	verbose("Connected: %q\n", conn.RemoteAddr())
 
+	if *optSecure {
+		if err = negotiateInitiatorKeys(conn); err != nil {
+			_ = conn.Close()
+			return err
+		}
+	}
+
 	err = callback(conn)
 	if err2 := conn.Close(); err == nil {
 		err = err2
@@ -115,7 +173,7 @@ func withEncryptingWriter(use bool, w io.Writer, callback func(io.Writer) error)
 	}
 	verbose("Using AES-GCM encryption\n")
 
-	encryptingWriter, err := NewEncryptor(w, key)
+	encryptingWriter, err := NewEncryptor(w, sendKey)
 	if err != nil {
 		return err
 	}
@@ -153,6 +211,13 @@ func withListen(bind string, callback func(ior io.Reader) error) error {
 	}
 	verbose("Accepted connection: %q\n", conn.RemoteAddr())
 
+	if *optSecure {
+		if err = negotiateResponderKeys(conn); err != nil {
+			_ = conn.Close()
+			return err
+		}
+	}
+
 	err = callback(conn)
 	if err2 := conn.Close(); err == nil {
 		err = err2
@@ -166,7 +231,7 @@ func withDecrpytingReader(use bool, r io.Reader, callback func(io.Reader) error)
 	}
 	verbose("Using AES-GCM encryption\n")
 
-	decryptingReader, err := NewDecryptor(r, key)
+	decryptingReader, err := NewDecryptor(r, recvKey)
 	if err != nil {
 		return err
 	}
@@ -215,6 +280,10 @@ func receiveLines(operands []string) error {
 	})
 }
 
+// receive accepts one connection on operands[0] and writes out whatever
+// send transmits. Regular files are written by their own goroutine as soon
+// as their frames arrive, rather than one at a time in tar order; see
+// receiveTree in mux.go.
 func receive(operands []string) error {
 	if len(operands) < 1 {
 		usage(fmt.Sprintf("cannot receive without binding address"))
@@ -222,111 +291,12 @@ func receive(operands []string) error {
 	return withListen(operands[0], func(r io.Reader) error {
 		return withDecrpytingReader(*optSecure, r, func(r io.Reader) error {
 			return withDecompressingReader(*optZip, r, func(r io.Reader) error {
-				var directories []dirBlurb
-
-				buf := make([]byte, 64*1024)
-
-				tarReader := tar.NewReader(r)
-				for {
-					th, err := tarReader.Next()
-					if err == io.EOF {
-						break
-					}
-					if err != nil {
-						return err
-					}
-
-					dirname := filepath.Dir(th.Name)
-					if err = os.MkdirAll(dirname, os.ModePerm); err != nil {
-						return err
-					}
-
-					switch th.Typeflag {
-					case tar.TypeDir:
-						_, err = os.Stat(th.Name)
-						if err == nil {
-							// TODO: what if entry is not a directory?
-							if err = os.Chmod(th.Name, os.FileMode(th.Mode)); err != nil {
-								return err
-							}
-						} else if os.IsNotExist(err) {
-							if err = os.Mkdir(th.Name, os.FileMode(th.Mode)); err != nil {
-								return err
-							}
-						}
-						// Cannot set the mtime of a directory entry now, but must do so
-						// after we process all the child entries in that directory. For
-						// now, we'll store a bit of information that we can use later
-						// to set the mtime for the directory.
-						directories = append(directories, dirBlurb{th.Name, th.ModTime})
-					case tar.TypeLink:
-						if err = os.Link(th.Linkname, th.Name); err != nil {
-							return err
-						}
-						if err = os.Chtimes(th.Name, th.ModTime, th.ModTime); err != nil {
-							return err
-						}
-					case tar.TypeSymlink:
-						if err = os.Symlink(th.Linkname, th.Name); err != nil {
-							return err
-						}
-						// ??? Chtimes does not seem to work on a symlink
-					case tar.TypeFifo:
-						if err = makeFIFO(th, tarReader, buf); err != nil {
-							return err
-						}
-					default:
-						// TODO: support tar.TypeBlock
-						// TODO: support tar.TypeChar
-						if err = makeRegular(tarReader, th, buf); err != nil {
-							return err
-						}
-					}
-				}
-
-				// Walk list of directories backwards, to ensure modification times are
-				// not updated by later updates deeper inside a directory
-				// location. Because program will send /foo through the pipe before
-				// /foo/bar, a reverse of the directory order will ensure we update the
-				// modification time for /foo/bar before we update the modification time
-				// for /foo.
-				for i := len(directories) - 1; i >= 0; i-- {
-					de := directories[i]
-					if err := os.Chtimes(de.Name, de.ModTime, de.ModTime); err != nil {
-						return err
-					}
-				}
-
-				return nil
+				return receiveTree(r)
 			})
 		})
 	})
 }
 
-func makeRegular(tr *tar.Reader, th *tar.Header, buf []byte) error {
-	// NOTE: Any other file type, including tar.TypeReg, ought to be written as
-	// a regular file, to be inspected by user.
-	tempName := th.Name + ".partial"
-	fh, err := os.OpenFile(tempName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(th.Mode))
-	if err != nil {
-		return err
-	}
-	nc, err := io.CopyBuffer(fh, tr, buf)
-	if err != nil {
-		return err
-	}
-	if err = fh.Close(); err != nil {
-		return err
-	}
-	if nc != th.Size {
-		return fmt.Errorf("mis-write: %d written, expected: %d", nc, th.Size)
-	}
-	if err = os.Rename(tempName, th.Name); err != nil {
-		return err
-	}
-	return os.Chtimes(th.Name, th.ModTime, th.ModTime)
-}
-
 // it would seem send transmits a format that native tar cannot decode
 
 func sendLines(operands []string) error {
@@ -351,6 +321,10 @@ func sendLines(operands []string) error {
 	})
 }
 
+// send transmits the given file system entries to operands[0]. The walk and
+// the actual network write run on different goroutines than the file reads;
+// see sendTree in mux.go for how they are multiplexed back onto one
+// connection.
 func send(operands []string) error {
 	if len(operands) < 1 {
 		usage(fmt.Sprintf("cannot send without destination address"))
@@ -358,119 +332,11 @@ func send(operands []string) error {
 	return withDial(operands[0], func(w io.Writer) error {
 		return withEncryptingWriter(*optSecure, w, func(w io.Writer) error {
 			return withCompressingWriter(*optZip, w, func(w io.Writer) error {
-				var err error
-				tarWriter := tar.NewWriter(w)
 				if len(operands) == 1 {
 					operands = append(operands, ".")
 				}
-				buf := make([]byte, 64*1024)
-				for _, operand := range operands[1:] {
-					if err = tarpath(tarWriter, operand, buf); err != nil {
-						break
-					}
-				}
-				if err2 := tarWriter.Close(); err == nil {
-					err = err2
-				}
-				return err
+				return sendTree(w, operands[1:])
 			})
 		})
 	})
 }
-
-func tarpath(tw *tar.Writer, osPathname string, buf []byte) error {
-	fi, err := os.Stat(osPathname)
-	if err != nil {
-		return err
-	}
-	if !fi.IsDir() {
-		return tarnode(tw, osPathname, buf)
-	}
-	return godirwalk.Walk(osPathname, &godirwalk.Options{
-		Callback: func(osPathname string, _ *godirwalk.Dirent) error {
-			return tarnode(tw, osPathname, buf)
-		},
-		ErrorCallback: func(osPathname string, err error) godirwalk.ErrorAction {
-			warning("%s: %s\n", osPathname, err)
-			return godirwalk.SkipNode
-		},
-		ScratchBuffer: make([]byte, 64*1024), // own buffer to walk directory
-		Unsorted:      true,
-	})
-}
-
-func tarnode(tw *tar.Writer, osPathname string, buf []byte) error {
-	fi, err := os.Lstat(osPathname)
-	if err != nil {
-		return err
-	}
-
-	mode := fi.Mode()
-
-	th := &tar.Header{
-		ModTime: fi.ModTime(),
-		Mode:    int64(mode),
-		Name:    osPathname,
-	}
-
-	if mode&os.ModeDir != 0 {
-		th.Typeflag = tar.TypeDir
-		return tw.WriteHeader(th)
-	}
-
-	if mode&os.ModeSymlink != 0 {
-		referent, err := os.Readlink(osPathname)
-		if err != nil {
-			return err
-		}
-		th.Linkname = referent
-		th.Typeflag = tar.TypeSymlink
-		return tw.WriteHeader(th)
-	}
-
-	if mode&os.ModeNamedPipe /* FIFO */ != 0 {
-		th.Typeflag = tar.TypeFifo
-		return tw.WriteHeader(th)
-	}
-
-	if mode&os.ModeSocket /* unix domain socket */ != 0 {
-		warning("%s: tar format cannot archive socket\n", osPathname)
-		return nil
-	}
-
-	if mode&os.ModeDevice /* including os.ModeCharDevice */ != 0 {
-		// os.ModeDevice (including os.ModeCharDevice) is not supported because
-		// I do not have a method of getting the major and minor device numbers
-		// of a file system entry without calling C.
-		warning("%s: cannot archive devices\n", osPathname)
-		return nil
-	}
-
-	if !mode.IsRegular() {
-		// At this point, if there are any remaining file mode bits, they are
-		// not supported, and ought to be skipped with an appropriate error
-		// message.
-		warning("%s: %s not supported\n", osPathname, mode)
-		return nil
-	}
-
-	// NOTE: There is no os library mode type for hard link, because every hard
-	// link is equal to each other hard link. Discovering whether a particular
-	// node is a hard link with another file in the same file system is an
-	// O(n^2) problem, and not solved here.
-
-	th.Size = int64(fi.Size())
-	th.Typeflag = tar.TypeReg
-	if err := tw.WriteHeader(th); err != nil {
-		return err
-	}
-	fh, err := os.Open(osPathname)
-	if err != nil {
-		return err
-	}
-	_, err = io.CopyBuffer(tw, fh, buf)
-	if err2 := fh.Close(); err == nil {
-		err = err2
-	}
-	return err
-}
@@ -4,7 +4,12 @@ package main
 
 import (
 	"archive/tar"
+	"fmt"
 	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -16,3 +21,134 @@ func makeFIFO(th *tar.Header, _ *tar.Reader, _ []byte) error {
 	}
 	return os.Chtimes(th.Name, th.ModTime, th.ModTime)
 }
+
+// paxSchilyXattr is the PAX record namespace tar and other archivers use to
+// carry a file's extended attributes; see tar(5) under SCHILY.xattr.
+const paxSchilyXattr = "SCHILY.xattr."
+
+// populateMetadata stats osPathname and fills in th with the POSIX metadata
+// that os.FileInfo does not expose: numeric owner, access and change times,
+// and any extended attributes. Owner names are resolved to Uname/Gname
+// unless --numeric-owner was given.
+func populateMetadata(th *tar.Header, osPathname string) (fileIdentity, error) {
+	var stat unix.Stat_t
+	if err := unix.Lstat(osPathname, &stat); err != nil {
+		return fileIdentity{}, fmt.Errorf("cannot stat: %w", err)
+	}
+
+	th.Uid = int(stat.Uid)
+	th.Gid = int(stat.Gid)
+	th.AccessTime = time.Unix(stat.Atim.Unix())
+	th.ChangeTime = time.Unix(stat.Ctim.Unix())
+
+	if !*optNumericOwner {
+		if u, err := user.LookupId(strconv.Itoa(th.Uid)); err == nil {
+			th.Uname = u.Username
+		}
+		if g, err := user.LookupGroupId(strconv.Itoa(th.Gid)); err == nil {
+			th.Gname = g.Name
+		}
+	}
+
+	populateXattrs(th, osPathname)
+
+	// A regular file whose allocated blocks cover less than its logical
+	// size has holes, the same heuristic `du` vs `ls -l` rely on.
+	sparse := stat.Mode&unix.S_IFMT == unix.S_IFREG && stat.Blocks*512 < stat.Size
+
+	return fileIdentity{
+		Dev:    uint64(stat.Dev),
+		Ino:    stat.Ino,
+		Nlink:  uint64(stat.Nlink),
+		Rdev:   uint64(stat.Rdev),
+		Sparse: sparse,
+	}, nil
+}
+
+// deviceNumbers splits a raw rdev value, as found in fileIdentity.Rdev, into
+// the major/minor pair tar.Header.Devmajor and Devminor expect.
+func deviceNumbers(rdev uint64) (major, minor int64) {
+	return int64(unix.Major(rdev)), int64(unix.Minor(rdev))
+}
+
+// makeDevice creates the block or character device described by th at
+// th.Name, restoring its recorded major/minor numbers.
+func makeDevice(th *tar.Header) error {
+	mode := uint32(th.Mode) | unix.S_IFBLK
+	if th.Typeflag == tar.TypeChar {
+		mode = uint32(th.Mode) | unix.S_IFCHR
+	}
+	dev := unix.Mkdev(uint32(th.Devmajor), uint32(th.Devminor))
+	if err := unix.Mknod(th.Name, mode, int(dev)); err != nil {
+		return err
+	}
+	return os.Chtimes(th.Name, th.ModTime, th.ModTime)
+}
+
+// populateXattrs reads the extended attributes of osPathname, if any, and
+// stores each as a PAX record under the SCHILY.xattr. namespace so it
+// survives the trip through the tar stream. Xattrs are best-effort
+// metadata: a file system that does not support them is not an error.
+func populateXattrs(th *tar.Header, osPathname string) {
+	size, err := unix.Llistxattr(osPathname, nil)
+	if err != nil || size == 0 {
+		return
+	}
+
+	names := make([]byte, size)
+	n, err := unix.Llistxattr(osPathname, names)
+	if err != nil {
+		warning("%s: cannot list xattrs: %s\n", osPathname, err)
+		return
+	}
+
+	for _, name := range strings.Split(strings.TrimRight(string(names[:n]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(osPathname, name, nil)
+		if err != nil || vsize == 0 {
+			continue
+		}
+		value := make([]byte, vsize)
+		vn, err := unix.Lgetxattr(osPathname, name, value)
+		if err != nil {
+			warning("%s: cannot read xattr %q: %s\n", osPathname, name, err)
+			continue
+		}
+		if th.PAXRecords == nil {
+			th.PAXRecords = make(map[string]string)
+		}
+		th.PAXRecords[paxSchilyXattr+name] = string(value[:vn])
+	}
+}
+
+// restoreMetadata re-applies the extended attributes carried in
+// th.PAXRecords, and, when running as root, the original ownership, onto
+// the file system entry just created at name.
+func restoreMetadata(name string, th *tar.Header) {
+	for key, value := range th.PAXRecords {
+		attr, ok := strings.CutPrefix(key, paxSchilyXattr)
+		if !ok {
+			continue
+		}
+		if err := unix.Lsetxattr(name, attr, []byte(value), 0); err != nil {
+			warning("%s: cannot restore xattr %q: %s\n", name, attr, err)
+		}
+	}
+
+	if os.Geteuid() == 0 {
+		if err := unix.Lchown(name, th.Uid, th.Gid); err != nil {
+			warning("%s: cannot chown: %s\n", name, err)
+		}
+
+		// chown(2) unconditionally clears S_ISUID/S_ISGID, even when the
+		// owner isn't actually changing, so put them back if the entry had
+		// them. Symlinks have no mode of their own to restore.
+		if th.Typeflag != tar.TypeSymlink && th.Mode&(c_ISUID|c_ISGID) != 0 {
+			if err := unix.Chmod(name, uint32(th.Mode)); err != nil {
+				warning("%s: cannot restore setuid/setgid: %s\n", name, err)
+			}
+		}
+	}
+}